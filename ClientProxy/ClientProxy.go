@@ -4,9 +4,11 @@ package main
 import (
 	"github.com/miekg/dns"
 	"flag"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -24,62 +26,52 @@ func _D(fmt string, v ...interface{}) {
 
 // this structure will be used by the dns.ListenAndServe() method
 type ClientProxy struct {
-	ACCESS      []*net.IPNet
-	SERVERS     []string
-	s_len       int
-	entries     int64
-	max_entries int64
-	NOW         int64
-	giant       *sync.RWMutex
-	timeout     time.Duration
+	ACCESS          []*net.IPNet
+	SERVERS         []string
+	s_len           int
+	entries         int64
+	max_entries     int64
+	NOW             int64
+	giant           *sync.RWMutex
+	timeout         time.Duration
+	conns           []*serverConn          // one persistent, self-healing conn per -proxy server
+	frags           *FragTable             // dispatches replies/fragments back to their ServeDNS goroutine
+	frag_key        []byte                 // preshared key to verify fragment HMACs, nil = disabled
+	sig0_key        *dns.KEY               // published KEY RR to verify fragment SIG(0) records against, nil = disabled
+	capabilityCache map[string]*capability // per-upstream fragmentation support, guarded by giant
+	capability_ttl  time.Duration          // how long a probed capability stays cached
 }
 
-// SRVFAIL result for serious problems
-func SRVFAIL(w dns.ResponseWriter, req *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetRcode(req, dns.RcodeServerFailure)
-	w.WriteMsg(m)
-}
-
-// wait for a matching reponse
-func wait_for_response(w dns.ResponseWriter, conn *dns.Conn, request *dns.Msg) (response *dns.Msg) {
-	for {
-		response, err := conn.ReadMsg()
-		// some sort of error reading reply
-		if err != nil {
-			_D("%s QID:%d error reading message: %s", w.RemoteAddr(), request.Id, err)
-			SRVFAIL(w, request)
-			return nil
-		}
-		// got a response, life is good
-		if response.Id == request.Id {
-			_D("%s QID:%d got reply", w.RemoteAddr(), request.Id)
-			return response
-		}
-		// got a response, but it was for a different QID... ignore
-		_D("%s QID:%d ignoring reply to wrong QID:%d", w.RemoteAddr(), request.Id, response.Id)
-	}
-}
-
-// extract out the total fragments and sequence number from the EDNS0 informaton in a packet
-func get_fragment_info(msg *dns.Msg) (num_frags int, sequence_num int) {
+// extract out the total fragments, sequence number, and (if present) the
+// authentication MAC from the EDNS0 information in a packet
+func get_fragment_info(msg *dns.Msg) (num_frags int, sequence_num int, mac []byte) {
 	num_frags = -1
 	sequence_num = -1
 	resp_edns0 := msg.IsEdns0()
 	if resp_edns0 != nil {
 		for _, opt := range resp_edns0.Option {
-			if opt.Option() == dns.EDNS0LOCALSTART + 1 {
-				num_frags = int(opt.(*dns.EDNS0_LOCAL).Data[0])
-				sequence_num = int(opt.(*dns.EDNS0_LOCAL).Data[1])
+			if opt.Option() == dns.EDNS0LOCALSTART+1 {
+				data := opt.(*dns.EDNS0_LOCAL).Data
+				num_frags = int(data[0])
+				sequence_num = int(data[1])
+				if len(data) >= 2+FragMACLen {
+					mac = data[2 : 2+FragMACLen]
+				}
 				// we only expect this option to be here once
 				break
 			}
 		}
 	}
-	return num_frags, sequence_num
+	return num_frags, sequence_num, mac
 }
 
-func (this ClientProxy) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
+func (this *ClientProxy) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
+	// pick an upstream server for this request the same way the baseline
+	// single-conn code did, for load-balancing/failover across the
+	// comma-separated -proxy servers; each serverConn is self-healing, so
+	// a transient error on one doesn't keep us pinned to it
+	sc := this.conns[rand.Intn(len(this.conns))]
+
 	// if we don't have EDNS0 in the packet, add it now
 	// TODO: in principle we should check packet size here, since we have made it bigger,
 	//       but for this demo code we will just rely on most queries being really small
@@ -95,115 +87,113 @@ func (this ClientProxy) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
 		client_buf_size = opt.UDPSize()
 	}
 
-	// add our custom EDNS0 option
-	local_opt := new(dns.EDNS0_LOCAL)
-	local_opt.Code = dns.EDNS0LOCALSTART
-	opt.Option = append(opt.Option, local_opt)
-
-	// create a connection to the server
-	// XXX: for now we will only handle UDP - this will break in unpredictable ways in production!
-	conn, err := dns.DialTimeout("udp", this.SERVERS[rand.Intn(len(this.SERVERS))], this.timeout)
-	if err != nil {
-		_D("%s QID:%d error setting up UDP socket: %s", w.RemoteAddr(), request.Id, err)
-		SRVFAIL(w, request)
-		return
+	// if the client's own query already carries our option (chained
+	// proxies), pass it through rather than adding a second copy
+	already_tagged := false
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0LOCALSTART {
+			already_tagged = true
+			break
+		}
 	}
-	defer conn.Close()
 
-	// set our timeouts
-	// TODO: we need to insure that our timeouts work like we expect
-	conn.SetReadDeadline(time.Now().Add(this.timeout))
-	conn.SetWriteDeadline(time.Now().Add(this.timeout))
-
-	// send our query
-	err = conn.WriteMsg(&proxy_req)
-	if err != nil {
-		_D("%s QID:%d error writing message: %s", w.RemoteAddr(), request.Id, err)
-		SRVFAIL(w, request)
-		return
+	if !already_tagged {
+		// don't bother tagging an upstream we've already probed and found
+		// doesn't understand the option; it would just ignore it, but
+		// there's no point risking it on a strict implementation
+		if this.capabilitySupported(sc, this.capability_ttl) {
+			// add our custom EDNS0 option, telling the ServerProxy the
+			// client's advertised UDP payload size so it can fragment to
+			// exactly that instead of a hardcoded 512
+			local_opt := new(dns.EDNS0_LOCAL)
+			local_opt.Code = dns.EDNS0LOCALSTART
+			local_opt.Data = []byte{byte(client_buf_size >> 8), byte(client_buf_size & 0xff)}
+			opt.Option = append(opt.Option, local_opt)
+		}
 	}
 
-	// wait for our reply
-	response := wait_for_response(w, conn, request)
-	if response == nil {
+	// assign our own QID for the upstream leg and register a waiter for it
+	// before we send, so we can't race the reply
+	qid, done, ok := this.frags.Register(w.RemoteAddr().String(), sc.addr)
+	if !ok {
+		_D("%s QID:%d reassembly table full, dropping query", w.RemoteAddr(), request.Id)
+		SRVFAILWithEDE(w, request, EDECodeFragmentMissing, "reassembly table full")
 		return
 	}
+	proxy_req.Id = qid
+	defer this.frags.Forget(qid)
 
-	// get fragment information from first response (if any)
-	num_frags, sequence_num := get_fragment_info(response)
-
-	// if we did not have a fragmented response, send it to the client
-	if num_frags == -1 {
-	    w.WriteMsg(response)
-	    return
+	if err := sc.write(&proxy_req); err != nil {
+		_D("%s QID:%d error writing message to %s: %s", w.RemoteAddr(), request.Id, sc.addr, err)
+		SRVFAILWithEDE(w, request, EDECodeUpstreamError, "error writing to upstream: "+err.Error())
+		return
 	}
 
-	// build a map to hold the fragments that we have received
-	frags := map[int]dns.Msg{ sequence_num: *response }
-
-	// wait for all fragments to arrive
-	// duplicates overwrite previous packet, missing packets eventually timeout
-	for len(frags) < num_frags {
-		response := wait_for_response(w, conn, request)
-		if response == nil {
-			return
-		}
-	        _, sequence_num := get_fragment_info(response)
-		// TODO: remove the extra EDNS0 option
-		frags[sequence_num] = *response
+	// wait for our (possibly reassembled) reply, or time out
+	var response *dns.Msg
+	select {
+	case response = <-done:
+	case <-time.After(this.timeout):
+		_D("%s QID:%d timed out waiting for upstream", w.RemoteAddr(), request.Id)
+		SRVFAILWithEDE(w, request, EDECodeReassemblyTimeout, fmt.Sprintf("reassembly timed out after %s", this.timeout))
+		return
 	}
-
-	// rebuild our original packet
-	rebuilt_reply, ok := frags[0]
-	if !ok {
-		_D("%s QID:%d missing fragment 0", w.RemoteAddr(), request.Id)
-		SRVFAIL(w, request)
+	if response == spoofedSentinel {
+		_D("%s QID:%d dropping reply: a fragment failed authentication", w.RemoteAddr(), request.Id)
+		SRVFAILWithEDE(w, request, EDECodeSpoofedFragment, "a fragment failed authentication (possible spoofing)")
 		return
 	}
-	for n := 1; n < num_frags; n++ {
-		frag, ok := frags[n]
-		if !ok {
-			_D("%s QID:%d missing fragment %d", w.RemoteAddr(), request.Id, n)
-			SRVFAIL(w, request)
-			return
-		}
-		rebuilt_reply.Answer = append(rebuilt_reply.Answer, frag.Answer...)
-		rebuilt_reply.Ns = append(rebuilt_reply.Ns, frag.Ns...)
-		for _, r := range frag.Extra {
-			// remove EDNS0 present in fragments from final answer
-			if r.Header().Rrtype != dns.TypeOPT {
-				rebuilt_reply.Extra = append(rebuilt_reply.Extra, r)
-			}
-		}
+	if response == nil {
+		_D("%s QID:%d missing fragment(s), giving up", w.RemoteAddr(), request.Id)
+		SRVFAILWithEDE(w, request, EDECodeFragmentMissing, "fragment(s) missing after reassembly deadline")
+		return
 	}
 
+	// the response we get back carries the QID we assigned the upstream
+	// leg, since ServerProxy/the upstream echo it; restore the client's own
+	response.Id = request.Id
+
 	// verify that we don't exceed the client buffer size
-	if rebuilt_reply.Len() > int(client_buf_size) {
+	if rebuilt_len := response.Len(); rebuilt_len > int(client_buf_size) {
 		// truncate if we need to
 		// TODO: test this
-		rebuilt_reply.MsgHdr.Truncated = true
-		rebuilt_reply.Answer = []dns.RR{}
-		rebuilt_reply.Ns = []dns.RR{}
-		rebuilt_reply.Extra = []dns.RR{}
+		extra := fmt.Sprintf("rebuilt reply %d > client buffer %d", rebuilt_len, client_buf_size)
+		response.MsgHdr.Truncated = true
+		response.Answer = []dns.RR{}
+		response.Ns = []dns.RR{}
+		response.Extra = []dns.RR{}
+		attachEDE(response, EDECodeReplyTooLarge, extra)
 	}
 
 	// send our rebuilt reply
-	w.WriteMsg(&rebuilt_reply)
+	w.WriteMsg(response)
 }
 
 func main() {
 
 	var (
-		S_SERVERS       string
-		S_LISTEN        string
-		S_ACCESS        string
-		timeout         int
-		max_entries     int64
-		expire_interval int64
+		S_SERVERS        string
+		S_LISTEN         string
+		S_ACCESS         string
+		S_FRAG_KEY       string
+		S_SIG0_PUBKEY    string
+		S_METRICS_LISTEN string
+		S_TLS_SERVERNAME string
+		S_TLS_CAFILE     string
+		S_TLS_SPKI_PIN   string
+		timeout          int
+		max_entries      int64
+		expire_interval  int64
 	)
 	flag.StringVar(&S_SERVERS, "proxy", "8.8.8.8:53,8.8.4.4:53", "we proxy requests to those servers")
 	flag.StringVar(&S_LISTEN, "listen", "[::]:53", "listen on (both tcp and udp)")
 	flag.StringVar(&S_ACCESS, "access", "127.0.0.0/8,10.0.0.0/8", "allow those networks, use 0.0.0.0/0 to allow everything")
+	flag.StringVar(&S_FRAG_KEY, "frag-key", "", "preshared key verifying fragment HMACs, shared with the ServerProxy (empty = fragments are unauthenticated)")
+	flag.StringVar(&S_SIG0_PUBKEY, "sig0-pubkey", "", "path prefix (without .key) of the ServerProxy's published dnssec-keygen KEY RR, to verify fragment SIG(0) records instead of -frag-key")
+	flag.StringVar(&S_METRICS_LISTEN, "metrics-listen", "", "if set, serve Prometheus-style reassembly counters at http://<addr>/metrics (empty = disabled)")
+	flag.StringVar(&S_TLS_SERVERNAME, "tls-servername", "", "override SNI/ServerName used for tls:// (DoT) -proxy entries")
+	flag.StringVar(&S_TLS_CAFILE, "tls-cafile", "", "PEM CA bundle to verify tls:// (DoT) -proxy entries against, instead of the system pool")
+	flag.StringVar(&S_TLS_SPKI_PIN, "tls-spki-pin", "", "base64 SHA-256 SPKI pin the tls:// (DoT) -proxy certificate must match")
 	flag.IntVar(&timeout, "timeout", 5, "timeout")
 	flag.Int64Var(&expire_interval, "expire_interval", 300, "delete expired entries every N seconds")
 	flag.BoolVar(&DEBUG, "debug", false, "enable/disable debug")
@@ -211,15 +201,62 @@ func main() {
 
 	flag.Parse()
 	servers := strings.Split(S_SERVERS, ",")
-	proxyer := ClientProxy{
-		giant:       new(sync.RWMutex),
-		ACCESS:      make([]*net.IPNet, 0),
-		SERVERS:     servers,
-		s_len:       len(servers),
-		NOW:         time.Now().UTC().Unix(),
-		entries:     0,
-		timeout:     time.Duration(timeout) * time.Second,
-		max_entries: max_entries}
+
+	tls_cfg, err := LoadTLSConfig(S_TLS_SERVERNAME, S_TLS_CAFILE, S_TLS_SPKI_PIN)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var frag_key []byte
+	if S_FRAG_KEY != "" {
+		frag_key = []byte(S_FRAG_KEY)
+	}
+
+	var sig0_key *dns.KEY
+	if S_SIG0_PUBKEY != "" {
+		var err error
+		sig0_key, err = LoadSIG0Verifier(S_SIG0_PUBKEY)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	frags := NewFragTable(max_entries,
+		time.Duration(timeout)*time.Second,
+		time.Duration(expire_interval)*time.Second)
+
+	conns := make([]*serverConn, len(servers))
+	for i, entry := range servers {
+		addr, dot := parseClientUpstream(entry)
+		conns[i] = newServerConn(addr, dot, tls_cfg, time.Duration(timeout)*time.Second, frags, frag_key, sig0_key)
+	}
+
+	proxyer := &ClientProxy{
+		giant:           new(sync.RWMutex),
+		ACCESS:          make([]*net.IPNet, 0),
+		SERVERS:         servers,
+		s_len:           len(servers),
+		NOW:             time.Now().UTC().Unix(),
+		entries:         0,
+		timeout:         time.Duration(timeout) * time.Second,
+		max_entries:     max_entries,
+		conns:           conns,
+		frag_key:        frag_key,
+		sig0_key:        sig0_key,
+		capabilityCache: make(map[string]*capability),
+		capability_ttl:  time.Duration(expire_interval) * time.Second,
+		frags:           frags,
+	}
+
+	if S_METRICS_LISTEN != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", proxyer.frags)
+		go func() {
+			if err := http.ListenAndServe(S_METRICS_LISTEN, mux); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	for _, mask := range strings.Split(S_ACCESS, ",") {
 		_, cidr, err := net.ParseCIDR(mask)
@@ -0,0 +1,45 @@
+// Extended DNS Errors (RFC 8914) for fragmentation-specific failures.
+//
+// A bare SERVFAIL doesn't tell an operator running `dig +ednsopt` *why*
+// reassembly failed. These codes live in the private-use range
+// (49152-65535) reserved by RFC 8914 section 10, since none of them
+// describe our situation precisely enough. Kept in sync by hand with the
+// matching file in ServerProxy (same codes, same attachEDE), the same way
+// the rest of this protocol's duplicated helpers are.
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+const (
+	EDECodeUpstreamError     uint16 = 49152 + iota // error sending the query to (or proxying it through) the upstream
+	EDECodeUpstreamNoEDNS0                         // ServerProxy-side: upstream reply was missing EDNS0 entirely
+	EDECodeReplyTooLarge                           // rebuilt reply exceeds the client's advertised buffer
+	EDECodeReassemblyTimeout                       // deadline passed before every fragment arrived
+	EDECodeFragmentMissing                         // reassembly table evicted/failed with fragment(s) never seen, or was full
+	EDECodeSpoofedFragment                         // a fragment failed MAC or SIG(0) verification
+)
+
+// attachEDE adds an EDNS0 Extended DNS Error option to msg, creating the
+// EDNS0 record if msg doesn't already have one.
+func attachEDE(msg *dns.Msg, code uint16, extra string) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(512, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  code,
+		ExtraText: extra,
+	})
+}
+
+// SRVFAILWithEDE returns a SERVFAIL annotated with an Extended DNS Error so
+// operators can see why, instead of a bare opaque failure.
+func SRVFAILWithEDE(w dns.ResponseWriter, req *dns.Msg, code uint16, extra string) {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	attachEDE(m, code, extra)
+	w.WriteMsg(m)
+}
@@ -0,0 +1,49 @@
+// Authentication for application-layer fragments.
+//
+// A fragment arriving out-of-band over UDP is trivially spoofable by any
+// off-path attacker who can guess the QID and inject toward the client. If
+// -frag-key is set, ServerProxy tags every fragment's custom EDNS0 option
+// with a truncated HMAC-SHA256; we recompute it here and drop anything
+// that doesn't match, counting it as a spoofing attempt.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/miekg/dns"
+)
+
+// FragMACLen is the truncated HMAC-SHA256 length ServerProxy attaches to
+// each fragment.
+const FragMACLen = 8
+
+// fragMAC computes the truncated HMAC-SHA256 over msg's wire bytes. msg's
+// EDNS0LOCALSTART+1 option must have its MAC bytes zeroed before packing,
+// so the verifier hashes exactly what the signer hashed.
+func fragMAC(key []byte, msg *dns.Msg) ([]byte, error) {
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(wire)
+	return mac.Sum(nil)[:FragMACLen], nil
+}
+
+// verifyFragment recomputes the MAC over a copy of msg with the MAC bytes
+// zeroed and compares it against the MAC the fragment arrived with.
+func verifyFragment(key []byte, msg *dns.Msg, total int, seq int, got_mac []byte) bool {
+	check := msg.Copy()
+	check_opt := check.IsEdns0()
+	for _, o := range check_opt.Option {
+		if o.Option() == dns.EDNS0LOCALSTART+1 {
+			o.(*dns.EDNS0_LOCAL).Data = append([]byte{byte(total), byte(seq)}, make([]byte, FragMACLen)...)
+		}
+	}
+	want_mac, err := fragMAC(key, check)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(want_mac, got_mac)
+}
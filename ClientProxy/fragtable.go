@@ -0,0 +1,248 @@
+// FragTable is the reassembly cache for ClientProxy. Since a single UDP
+// conn to the ServerProxy is now shared across every client query,
+// responses (and their fragments) can arrive interleaved and out of order;
+// FragTable is what lets ServeDNS find the right goroutine to hand each one
+// to, keyed on the QID ClientProxy itself assigned the upstream query.
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// one in-flight request: the client it came from (recorded only; no code
+// reads it back), the upstream
+// it was dispatched to (so a reply arriving on a different serverConn can't
+// be mistaken for it on a QID collision), fragments collected so far, and
+// the channel its ServeDNS goroutine is waiting on
+type fragEntry struct {
+	remote    string
+	upstream  string // sc.addr the request was sent to; replies from any other upstream are rejected
+	created   time.Time
+	num_frags int
+	frags     map[int]dns.Msg
+	done      chan *dns.Msg
+}
+
+// FragTable tracks in-flight requests keyed by the QID ClientProxy assigned
+// when it forwarded the query upstream, so the shared connection's reader
+// goroutine can dispatch each reply to the right waiter and collect
+// fragments asynchronously. Stale entries are evicted on a timer so a
+// missing fragment can't leak an entry forever.
+type FragTable struct {
+	// counters come first so they stay 64-bit aligned for sync/atomic on
+	// 32-bit platforms; they're written from both the shared conn's read
+	// loop and evictLoop's timer, so every update goes through atomic
+	// rather than t.mu (which Deliver already has to release before doing
+	// the expensive, lock-free reassembly work).
+	Received  int64
+	Duplicate int64
+	Late      int64
+	Lost      int64
+	Spoofed   int64 // fragments dropped for failing MAC/SIG(0) verification
+
+	mu              sync.Mutex
+	entries         map[uint16]*fragEntry
+	max_entries     int64
+	entry_timeout   time.Duration
+	expire_interval time.Duration
+}
+
+// NewFragTable builds a FragTable and starts its background eviction
+// goroutine. entry_timeout bounds how long we wait for all fragments of a
+// single request; expire_interval is how often we sweep for stale entries.
+func NewFragTable(max_entries int64, entry_timeout time.Duration, expire_interval time.Duration) *FragTable {
+	t := &FragTable{
+		entries:         make(map[uint16]*fragEntry),
+		max_entries:     max_entries,
+		entry_timeout:   entry_timeout,
+		expire_interval: expire_interval,
+	}
+	go t.evictLoop()
+	return t
+}
+
+// Register picks a QID that isn't already in use in the table, registers a
+// waiter for it, and returns the QID to send upstream along with the
+// channel its fragments (or final SERVFAIL) will be delivered on. upstream
+// is the serverConn's address the request is about to be sent to; Deliver
+// and MarkSpoofed only accept replies reported by that same upstream, so a
+// QID collision across two configured -proxy servers can't hand one
+// request's reassembly to the other's reply. It returns ok == false if the
+// table is already at max_entries.
+func (t *FragTable) Register(remote string, upstream string) (qid uint16, done chan *dns.Msg, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.max_entries > 0 && int64(len(t.entries)) >= t.max_entries {
+		return 0, nil, false
+	}
+
+	for {
+		qid = uint16(rand.Intn(65536))
+		if _, taken := t.entries[qid]; !taken {
+			break
+		}
+	}
+
+	done = make(chan *dns.Msg, 1)
+	t.entries[qid] = &fragEntry{
+		remote:   remote,
+		upstream: upstream,
+		created:  time.Now(),
+		done:     done,
+	}
+	return qid, done, true
+}
+
+// Forget removes a waiter once ServeDNS is done with it, win or lose.
+func (t *FragTable) Forget(qid uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, qid)
+}
+
+// spoofedSentinel is delivered in place of a response when a fragment
+// failed authentication, so ServeDNS can tell a forged fragment apart from
+// ordinary packet loss (which delivers nil) and answer with the more
+// specific EDECodeSpoofedFragment instead of a generic timeout/missing
+// error.
+var spoofedSentinel = &dns.Msg{}
+
+// MarkSpoofed tears down the waiter for qid, if any, and wakes it with
+// spoofedSentinel instead of leaving it to time out looking like ordinary
+// fragment loss. upstream must match the serverConn the waiter was
+// registered against, the same way Deliver checks it, so a bad fragment
+// from one upstream can't tear down a request in flight to another.
+func (t *FragTable) MarkSpoofed(upstream string, qid uint16) {
+	t.mu.Lock()
+	entry, ok := t.entries[qid]
+	if !ok || entry.upstream != upstream {
+		t.mu.Unlock()
+		atomic.AddInt64(&t.Spoofed, 1)
+		return
+	}
+	delete(t.entries, qid)
+	t.mu.Unlock()
+
+	atomic.AddInt64(&t.Spoofed, 1)
+	select {
+	case entry.done <- spoofedSentinel:
+	default:
+	}
+}
+
+// Deliver hands a response (fragment or not) to the matching waiter.
+// num_frags == -1 means the response wasn't fragmented at all. upstream is
+// the serverConn address the response actually arrived on; it must match
+// the upstream the waiter's request was sent to, or the reply is rejected
+// as if it were for an unknown QID. Without this, two configured -proxy
+// servers could collide on a self-assigned QID and one server's reply
+// would be handed to the other's waiter.
+func (t *FragTable) Deliver(upstream string, response *dns.Msg, num_frags int, sequence_num int) {
+	t.mu.Lock()
+	entry, ok := t.entries[response.Id]
+	if !ok || entry.upstream != upstream {
+		t.mu.Unlock()
+		// either it already completed/expired, belongs to a different
+		// upstream, or a reply for a QID we never sent: nothing sensible
+		// to do with it
+		atomic.AddInt64(&t.Late, 1)
+		return
+	}
+
+	if num_frags == -1 {
+		delete(t.entries, response.Id)
+		t.mu.Unlock()
+		atomic.AddInt64(&t.Received, 1)
+		entry.done <- response
+		return
+	}
+
+	if entry.frags == nil {
+		entry.num_frags = num_frags
+		entry.frags = make(map[int]dns.Msg, num_frags)
+	}
+	if _, dup := entry.frags[sequence_num]; dup {
+		t.mu.Unlock()
+		atomic.AddInt64(&t.Duplicate, 1)
+		return
+	}
+	entry.frags[sequence_num] = *response
+	atomic.AddInt64(&t.Received, 1)
+
+	if len(entry.frags) < entry.num_frags {
+		t.mu.Unlock()
+		return
+	}
+
+	// all fragments are in: rebuild and deliver
+	delete(t.entries, response.Id)
+	t.mu.Unlock()
+
+	rebuilt, ok := rebuildFragments(entry.frags, entry.num_frags)
+	if !ok {
+		atomic.AddInt64(&t.Lost, 1)
+		entry.done <- nil
+		return
+	}
+	entry.done <- rebuilt
+}
+
+// evictLoop runs until the process exits, periodically dropping entries
+// that have waited longer than entry_timeout without completing.
+func (t *FragTable) evictLoop() {
+	ticker := time.NewTicker(t.expire_interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		t.mu.Lock()
+		for qid, entry := range t.entries {
+			if now.Sub(entry.created) > t.entry_timeout {
+				delete(t.entries, qid)
+				atomic.AddInt64(&t.Lost, 1)
+				// nil unblocks the waiting ServeDNS goroutine with a SRVFAIL
+				select {
+				case entry.done <- nil:
+				default:
+				}
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Len reports how many requests are currently in flight.
+func (t *FragTable) Len() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return int64(len(t.entries))
+}
+
+// rebuildFragments stitches a complete set of fragments back into a single
+// reply, in sequence order, dropping the per-fragment EDNS0 copies.
+func rebuildFragments(frags map[int]dns.Msg, num_frags int) (*dns.Msg, bool) {
+	first, ok := frags[0]
+	if !ok {
+		return nil, false
+	}
+	rebuilt := first
+	for n := 1; n < num_frags; n++ {
+		frag, ok := frags[n]
+		if !ok {
+			return nil, false
+		}
+		rebuilt.Answer = append(rebuilt.Answer, frag.Answer...)
+		rebuilt.Ns = append(rebuilt.Ns, frag.Ns...)
+		for _, r := range frag.Extra {
+			if r.Header().Rrtype != dns.TypeOPT {
+				rebuilt.Extra = append(rebuilt.Extra, r)
+			}
+		}
+	}
+	return &rebuilt, true
+}
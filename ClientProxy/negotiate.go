@@ -0,0 +1,94 @@
+// Capability negotiation for the custom EDNS0 fragmentation option.
+//
+// ClientProxy used to assume every upstream understood EDNS0LOCALSTART and
+// always added it. That's fine talking to our own ServerProxy, but breaks
+// down the moment the upstream is a plain recursive resolver, or another
+// ServerProxy running an older build: with no handshake we can't tell
+// "doesn't support it" from "silently ignored it", so we probe once per
+// upstream and cache the answer.
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// capability records whether a given upstream echoes EDNS0LOCALSTART back
+// (proof that it understands application-layer fragmentation), and when we
+// last found out.
+type capability struct {
+	supported bool
+	checked   time.Time
+}
+
+// capabilitySupported reports whether sc's upstream is known to support our
+// fragmentation option, probing it (and caching the result for ttl) if we
+// haven't asked recently. capability state lives under this.giant, the
+// RWMutex the struct already carried for exactly this kind of shared state.
+func (this *ClientProxy) capabilitySupported(sc *serverConn, ttl time.Duration) bool {
+	this.giant.RLock()
+	entry, ok := this.capabilityCache[sc.addr]
+	this.giant.RUnlock()
+
+	if ok && time.Since(entry.checked) < ttl {
+		return entry.supported
+	}
+
+	supported := this.probe(sc)
+
+	this.giant.Lock()
+	this.capabilityCache[sc.addr] = &capability{supported: supported, checked: time.Now()}
+	this.giant.Unlock()
+
+	return supported
+}
+
+// probe sends a synthetic CH TXT query carrying our fragmentation option
+// and reports whether the reply echoed it back. It rides the same conn and
+// FragTable as real client queries sent through sc.
+func (this *ClientProxy) probe(sc *serverConn) bool {
+	probe_req := new(dns.Msg)
+	probe_req.SetQuestion("frag-probe.", dns.TypeTXT)
+	probe_req.Question[0].Qclass = dns.ClassCHAOS
+	probe_req.SetEdns0(512, false)
+
+	opt := probe_req.IsEdns0()
+	local_opt := new(dns.EDNS0_LOCAL)
+	local_opt.Code = dns.EDNS0LOCALSTART
+	opt.Option = append(opt.Option, local_opt)
+
+	qid, done, ok := this.frags.Register(sc.addr, sc.addr)
+	if !ok {
+		return false
+	}
+	defer this.frags.Forget(qid)
+	probe_req.Id = qid
+
+	if err := sc.write(probe_req); err != nil {
+		_D("error sending capability probe to %s: %s", sc.addr, err)
+		return false
+	}
+
+	var response *dns.Msg
+	select {
+	case response = <-done:
+	case <-time.After(this.timeout):
+		_D("capability probe to %s timed out", sc.addr)
+		return false
+	}
+	if response == nil || response == spoofedSentinel {
+		return false
+	}
+
+	resp_opt := response.IsEdns0()
+	if resp_opt == nil {
+		return false
+	}
+	for _, o := range resp_opt.Option {
+		if o.Option() == dns.EDNS0LOCALSTART {
+			return true
+		}
+	}
+	return false
+}
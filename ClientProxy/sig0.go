@@ -0,0 +1,52 @@
+// SIG(0) (RFC 2931) verification of fragments, the ClientProxy-side
+// counterpart of the signing half in ServerProxy/sig0.go: instead of a
+// shared secret, a fragment is checked against a published KEY RR.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/miekg/dns"
+)
+
+// LoadSIG0Verifier reads the public half of a BIND-style dnssec-keygen
+// keypair (the .key file) and returns the KEY RR fragments are verified
+// against. base is the path without its .key suffix, matching how
+// ServerProxy's -sig0-key names the same keypair.
+func LoadSIG0Verifier(base string) (*dns.KEY, error) {
+	pub, err := ioutil.ReadFile(base + ".key")
+	if err != nil {
+		return nil, fmt.Errorf("reading -sig0-pubkey: %s", err)
+	}
+	rr, err := dns.NewRR(string(pub))
+	if err != nil {
+		return nil, fmt.Errorf("parsing -sig0-pubkey KEY RR: %s", err)
+	}
+	key_rr, ok := rr.(*dns.KEY)
+	if !ok {
+		return nil, fmt.Errorf("-sig0-pubkey %s.key is not a KEY record", base)
+	}
+	return key_rr, nil
+}
+
+// verifySIG0 reports whether msg carries a SIG(0) record that verifies
+// against key. SIG.Verify walks the packed message's header counts to find
+// where the SIG record itself starts, so it needs the SIG RR still present
+// and last in Extra, exactly as ServerProxy.Sign left it; we just re-pack
+// msg as received and hand the whole thing to Verify.
+func verifySIG0(key *dns.KEY, msg *dns.Msg) bool {
+	if len(msg.Extra) == 0 {
+		return false
+	}
+	sig, ok := msg.Extra[len(msg.Extra)-1].(*dns.SIG)
+	if !ok {
+		return false
+	}
+
+	wire, err := msg.Pack()
+	if err != nil {
+		return false
+	}
+	return sig.Verify(key, wire) == nil
+}
@@ -0,0 +1,59 @@
+// TLS config for DoT (-tls://) upstream servers, the ClientProxy-side
+// counterpart of the TLS helpers in ServerProxy/upstream.go. ClientProxy
+// doesn't support DoH: the fragmentation protocol delivers a variable
+// number of reply messages per query pushed asynchronously off a shared
+// conn, which has no equivalent in DoH's one-request-one-response HTTP
+// model, so only the DNS and DoT transports are offered here.
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+)
+
+// LoadTLSConfig builds a *tls.Config from the -tls-* flags, same semantics
+// as ServerProxy's: server_name overrides SNI, ca_file replaces the system
+// root pool, spki_pin pins the leaf certificate's SPKI hash.
+func LoadTLSConfig(server_name string, ca_file string, spki_pin string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: server_name}
+
+	if ca_file != "" {
+		pem, err := ioutil.ReadFile(ca_file)
+		if err != nil {
+			return nil, fmt.Errorf("reading -tls-cafile: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in -tls-cafile %s", ca_file)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if spki_pin != "" {
+		want := spki_pin
+		cfg.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+			for _, der := range certs {
+				if spkiPin(der) == want {
+					return nil
+				}
+			}
+			return fmt.Errorf("no certificate matched -tls-spki-pin")
+		}
+	}
+
+	return cfg, nil
+}
+
+// spkiPin computes the base64 SHA-256 of the certificate's SubjectPublicKeyInfo.
+func spkiPin(der []byte) string {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,172 @@
+// Per-upstream-server connections for ClientProxy, including optional DoT
+// (RFC 7858) transport to the -proxy servers. The baseline code picked a
+// random -proxy server per request for load-balancing/failover across
+// comma-separated servers; FragTable's shared-conn rework regressed that
+// down to a single server dialed once at startup, with no reconnect if
+// that one conn errored out. serverConn restores both: one persistent,
+// self-healing conn per configured server, chosen at random per request
+// the same way the baseline did.
+//
+// DoH isn't offered here, unlike ServerProxy's upstream transports:
+// fragmentation delivers a variable number of reply messages per query,
+// pushed asynchronously off a shared conn's read loop, which has no
+// equivalent in DoH's one-request-one-response HTTP model.
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serverConn owns one persistent connection to a single upstream server
+// and the read loop that feeds replies arriving on it into a shared
+// FragTable. It reconnects (with a short backoff) whenever the conn
+// errors out, so one upstream hiccuping doesn't take down the whole
+// proxy's path to every other configured server.
+type serverConn struct {
+	addr     string // host:port to dial; tls:// prefix already stripped
+	dot      bool   // dial with TLS (DoT) instead of plain UDP
+	tls_cfg  *tls.Config
+	timeout  time.Duration
+	frags    *FragTable
+	frag_key []byte
+	sig0_key *dns.KEY
+
+	mu   sync.Mutex
+	conn *dns.Conn
+}
+
+// parseClientUpstream splits a -proxy entry into the bare host:port and
+// whether it should be reached over DoT, honouring an explicit tls://
+// prefix (DoT always defaults to port 853 when none is given).
+func parseClientUpstream(entry string) (addr string, dot bool) {
+	if !strings.HasPrefix(entry, "tls://") {
+		return entry, false
+	}
+	addr = strings.TrimPrefix(entry, "tls://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "853")
+	}
+	return addr, true
+}
+
+// newServerConn builds a serverConn and starts its background read loop.
+func newServerConn(addr string, dot bool, tls_cfg *tls.Config, timeout time.Duration, frags *FragTable, frag_key []byte, sig0_key *dns.KEY) *serverConn {
+	sc := &serverConn{
+		addr:     addr,
+		dot:      dot,
+		tls_cfg:  tls_cfg,
+		timeout:  timeout,
+		frags:    frags,
+		frag_key: frag_key,
+		sig0_key: sig0_key,
+	}
+	go sc.readLoop()
+	return sc
+}
+
+// dial (re)connects to sc.addr over DoT or plain UDP, and stores the
+// result. Callers must hold sc.mu.
+func (sc *serverConn) dial() (*dns.Conn, error) {
+	if sc.dot {
+		dialer := &net.Dialer{Timeout: sc.timeout}
+		tls_conn, err := tls.DialWithDialer(dialer, "tcp", sc.addr, sc.tls_cfg)
+		if err != nil {
+			return nil, err
+		}
+		conn := &dns.Conn{Conn: tls_conn}
+		sc.conn = conn
+		return conn, nil
+	}
+	conn, err := dns.DialTimeout("udp", sc.addr, sc.timeout)
+	if err != nil {
+		return nil, err
+	}
+	sc.conn = conn
+	return conn, nil
+}
+
+// write sends msg, dialing first if we don't currently have a live conn.
+// On a write error the conn is dropped so the next write (or the read
+// loop) redials instead of reusing a dead socket.
+func (sc *serverConn) write(msg *dns.Msg) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.conn == nil {
+		if _, err := sc.dial(); err != nil {
+			return err
+		}
+	}
+	sc.conn.SetWriteDeadline(time.Now().Add(sc.timeout))
+	if err := sc.conn.WriteMsg(msg); err != nil {
+		sc.conn.Close()
+		sc.conn = nil
+		return err
+	}
+	return nil
+}
+
+// readLoop owns sc's read side for the lifetime of the process. Any read
+// (or connect) error drops the conn and retries after a short, capped
+// backoff instead of giving up on this upstream forever.
+func (sc *serverConn) readLoop() {
+	backoff := 100 * time.Millisecond
+	const maxBackoff = 5 * time.Second
+
+	for {
+		sc.mu.Lock()
+		conn := sc.conn
+		if conn == nil {
+			var err error
+			conn, err = sc.dial()
+			if err != nil {
+				sc.mu.Unlock()
+				_D("error connecting to upstream %s: %s", sc.addr, err)
+				time.Sleep(backoff)
+				if backoff < maxBackoff {
+					backoff *= 2
+				}
+				continue
+			}
+		}
+		sc.mu.Unlock()
+		backoff = 100 * time.Millisecond
+
+		response, err := conn.ReadMsg()
+		if err != nil {
+			_D("error reading from upstream %s: %s, reconnecting", sc.addr, err)
+			sc.mu.Lock()
+			if sc.conn == conn {
+				sc.conn.Close()
+				sc.conn = nil
+			}
+			sc.mu.Unlock()
+			time.Sleep(backoff)
+			continue
+		}
+
+		num_frags, sequence_num, mac := get_fragment_info(response)
+		if num_frags != -1 {
+			switch {
+			case sc.sig0_key != nil:
+				if !verifySIG0(sc.sig0_key, response) {
+					_D("QID:%d dropping fragment %d/%d from %s with invalid SIG(0) (possible spoofing attempt)", response.Id, sequence_num, num_frags, sc.addr)
+					sc.frags.MarkSpoofed(sc.addr, response.Id)
+					continue
+				}
+			case sc.frag_key != nil:
+				if mac == nil || !verifyFragment(sc.frag_key, response, num_frags, sequence_num, mac) {
+					_D("QID:%d dropping fragment %d/%d from %s with invalid MAC (possible spoofing attempt)", response.Id, sequence_num, num_frags, sc.addr)
+					sc.frags.MarkSpoofed(sc.addr, response.Id)
+					continue
+				}
+			}
+		}
+		sc.frags.Deliver(sc.addr, response, num_frags, sequence_num)
+	}
+}
@@ -26,19 +26,16 @@ func _D(fmt string, v ...interface{}) {
 type ServerProxy struct {
 	ACCESS      []*net.IPNet
 	SERVERS     []string
+	UPSTREAMS   []*Upstream
 	s_len       int
 	entries     int64
 	max_entries int64
 	NOW         int64
 	giant       *sync.RWMutex
 	timeout     time.Duration
-}
-
-// SRVFAIL result for serious problems
-func (this ServerProxy) SRVFAIL(w dns.ResponseWriter, req *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetRcode(req, dns.RcodeServerFailure)
-	w.WriteMsg(m)
+	frag_mtu    int         // operator override of the fragment budget, 0 = use client's advertised size
+	frag_key    []byte      // preshared key for HMAC fragment authentication, nil = disabled; mutually exclusive with sig0
+	sig0        *SIG0Signer // SIG(0) signer for fragments, nil = disabled; mutually exclusive with frag_key
 }
 
 /*
@@ -47,18 +44,16 @@ For fragmentation, we use a naive algorithm.
 We use the same header for every fragment, and include the same EDNS0
 section in every additional section.
 
-We add one RR at a time, until our fragment is larger than 512 bytes,
-then we remove the last RR so that it fits in the 512 byte size limit.
+Rather than adding one RR at a time and backing off when a fragment goes
+over budget, we bisect: given the remaining RR slice, try all N; if too
+large, halve; converge on the largest prefix that fits. That turns what
+used to be an O(N) run of dns.Msg.Len() calls (which re-pack the whole
+message on every call) into O(log N) per fragment.
 
 If we discover that one of the fragments ends up with 0 RR in it (for
 example because a single RR is too big), then we return a single
 truncated response instead of the set of fragments.
 
-We could perhaps make the process of building fragments faster by
-bisecting the set of RR that we include in an answer. So, if we have 8
-RR we could try all, then if that is too big, 4 RR, and if that fits
-then 6 RR, until an optimal set of RR is found.
-
 We could also possibly produce a smaller set of responses by
 optimizing how we combine RR. Just taking account the various sizes is
 the same as the bin packing problem, which is NP-hard:
@@ -69,7 +64,32 @@ While some non-optimal but reasonable heuristics exist, in the case of
 DNS we would have to use some sophisticated algorithm to also consider
 name compression.
 */
-func frag(reply *dns.Msg) []dns.Msg {
+
+// bisectFit returns the largest k in [0, n] for which fits(k) is true,
+// assuming fits is monotonic (fits(k) => fits(k-1)): try n, then halve,
+// converging on the boundary in O(log n) calls instead of O(n).
+func bisectFit(n int, fits func(k int) bool) int {
+	if n == 0 || fits(n) {
+		return n
+	}
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+// DefaultFragBudget is the fragment size used when the client never told
+// us its UDP payload size (e.g. a pre-negotiation EDNS0LOCALSTART option
+// with no size sub-option).
+const DefaultFragBudget = 512
+
+func frag(reply *dns.Msg, budget int, frag_key []byte) []dns.Msg {
 	// create a return value
 	all_frags := []dns.Msg{}
 	HasEdns0 := true
@@ -130,40 +150,29 @@ func frag(reply *dns.Msg) []dns.Msg {
 		//	frag.Extra = append(frag.Extra, local_opt)
 		//}
 
-		// add as many RR to the answer as we can
-		for len(remaining_answer) > 0 {
-			frag.Answer = append(frag.Answer, remaining_answer[0])
-			if frag.Len() <= 512 {
-				// if the new answer fits, then remove it from our remaining list
-				remaining_answer = remaining_answer[1:]
-			} else {
-				// otherwise we are full, remove it from our fragment and stop
-				frag.Answer = frag.Answer[0 : len(frag.Answer)-1]
-				break
-			}
-		}
-		for len(remaining_ns) > 0 {
-			frag.Ns = append(frag.Ns, remaining_ns[0])
-			if frag.Len() <= 512 {
-				// if the new answer fits, then remove it from our remaining list
-				remaining_ns = remaining_ns[1:]
-			} else {
-				// otherwise we are full, remove it from our fragment and stop
-				frag.Ns = frag.Ns[0 : len(frag.Ns)-1]
-				break
-			}
-		}
-		for len(remaining_extra) > 0 {
-			frag.Extra = append(frag.Extra, remaining_extra[0])
-			if frag.Len() <= 512 {
-				// if the new answer fits, then remove it from our remaining list
-				remaining_extra = remaining_extra[1:]
-			} else {
-				// otherwise we are full, remove it from our fragment and stop
-				frag.Extra = frag.Extra[0 : len(frag.Extra)-1]
-				break
-			}
-		}
+		// bisect each section in turn to find the largest prefix of the
+		// remaining RR that still fits the budget, given what's already
+		// been placed in this fragment
+		k := bisectFit(len(remaining_answer), func(k int) bool {
+			frag.Answer = remaining_answer[0:k]
+			return frag.Len() <= budget
+		})
+		frag.Answer = remaining_answer[0:k]
+		remaining_answer = remaining_answer[k:]
+
+		k = bisectFit(len(remaining_ns), func(k int) bool {
+			frag.Ns = remaining_ns[0:k]
+			return frag.Len() <= budget
+		})
+		frag.Ns = remaining_ns[0:k]
+		remaining_ns = remaining_ns[k:]
+
+		k = bisectFit(len(remaining_extra), func(k int) bool {
+			frag.Extra = append(frag.Extra[0:1], remaining_extra[0:k]...)
+			return frag.Len() <= budget
+		})
+		frag.Extra = append(frag.Extra[0:1], remaining_extra[0:k]...)
+		remaining_extra = remaining_extra[k:]
 
 		// check to see if we didn't manage to add any RR
 		if (len(frag.Answer) == 0) && (len(frag.Ns) == 0) && (len(frag.Extra) == 1) {
@@ -182,8 +191,17 @@ func frag(reply *dns.Msg) []dns.Msg {
 		}
 	}
 
-	// fix up our fragments so they have the correct sequence and length values
-	for n, frag := range all_frags {
+	// fix up our fragments so they have the correct sequence and length
+	// values, and, if -frag-key is set, an authentication MAC so
+	// ClientProxy can tell a genuine fragment from an off-path forgery
+	for n := range all_frags {
+		frag := &all_frags[n]
+		if frag_key != nil {
+			if err := signFragment(frag_key, frag, len(all_frags), n); err != nil {
+				log.Printf("error signing fragment %d: %s", n, err)
+			}
+			continue
+		}
 		frag_edns0 := frag.IsEdns0()
 		for _, opt := range frag_edns0.Option {
 			if opt.Option() == dns.EDNS0LOCALSTART+1 {
@@ -200,12 +218,20 @@ func frag(reply *dns.Msg) []dns.Msg {
 func (this ServerProxy) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
 	// see if we have our groovy custom EDNS0 option
 	client_supports_appfrag := false
+	frag_budget := DefaultFragBudget
 	opt := request.IsEdns0()
 	if opt != nil {
 		for ofs, e := range opt.Option {
 			if e.Option() == dns.EDNS0LOCALSTART {
 				_D("%s QID:%d found EDNS0LOCALSTART", w.RemoteAddr(), request.Id)
 				client_supports_appfrag = true
+				// the ClientProxy packs its client's advertised UDP
+				// payload size into the option data, so we can fragment
+				// to exactly what the client can receive instead of a
+				// hardcoded 512
+				if data := e.(*dns.EDNS0_LOCAL).Data; len(data) >= 2 {
+					frag_budget = int(data[0])<<8 | int(data[1])
+				}
 				// go ahead and use the maximum UDP size for the local communication
 				// with our server
 				opt.SetUDPSize(65535)
@@ -217,14 +243,20 @@ func (this ServerProxy) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
 		}
 	}
 
-	// proxy the query
-	c := new(dns.Client)
-	c.ReadTimeout = this.timeout
-	c.WriteTimeout = this.timeout
-	response, rtt, err := c.Exchange(request, this.SERVERS[rand.Intn(this.s_len)])
+	// an operator-set -frag-mtu caps the budget for path-MTU-constrained
+	// networks, regardless of what the client advertised
+	if this.frag_mtu > 0 && this.frag_mtu < frag_budget {
+		frag_budget = this.frag_mtu
+	}
+
+	// proxy the query to one of our upstreams (plain DNS, DoH or DoT); the
+	// fragmentation below is applied to whatever comes back regardless of
+	// which transport reached the upstream
+	upstream := this.UPSTREAMS[rand.Intn(this.s_len)]
+	response, rtt, err := upstream.Exchange(request, this.timeout)
 	if err != nil {
 		_D("%s QID:%d error proxying query: %s", w.RemoteAddr(), request.Id, err)
-		this.SRVFAIL(w, request)
+		this.SRVFAILWithEDE(w, request, EDECodeUpstreamError, "error proxying query: "+err.Error())
 		return
 	}
 	_D("%s QID:%d request took %s", w.RemoteAddr(), request.Id, rtt)
@@ -236,46 +268,130 @@ func (this ServerProxy) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
 		return
 	}
 
+	// echo the fragmentation option back so the ClientProxy's capability
+	// probe (and any chained proxy) can tell we actually understood it,
+	// separately from whether this particular reply ends up fragmented
+	if resp_opt := response.IsEdns0(); resp_opt != nil {
+		ack := new(dns.EDNS0_LOCAL)
+		ack.Code = dns.EDNS0LOCALSTART
+		resp_opt.Option = append(resp_opt.Option, ack)
+	}
+
 	// otherwise lets get our fragments
-	all_frags := frag(response)
+	all_frags := frag(response, frag_budget, this.frag_key)
+	if len(all_frags) == 0 {
+		_D("%s QID:%d upstream reply had no EDNS0 to fragment against", w.RemoteAddr(), request.Id)
+		this.SRVFAILWithEDE(w, request, EDECodeUpstreamNoEDNS0, "upstream stripped EDNS0")
+		return
+	}
 
 	// send our fragments
-	for n, frag := range all_frags {
+	for n := range all_frags {
+		frag := &all_frags[n]
+		if this.sig0 != nil {
+			if err := this.sig0.Sign(frag); err != nil {
+				_D("%s QID:%d error signing fragment %d with SIG(0): %s", w.RemoteAddr(), request.Id, n, err)
+			}
+		}
 		_D("%s QID:%d sending fragment %d", w.RemoteAddr(), request.Id, n)
-		w.WriteMsg(&frag)
+		w.WriteMsg(frag)
 	}
 }
 
 func main() {
 
 	var (
-		S_SERVERS       string
-		S_LISTEN        string
-		S_ACCESS        string
-		timeout         int
-		max_entries     int64
-		expire_interval int64
+		S_SERVERS        string
+		S_LISTEN         string
+		S_ACCESS         string
+		S_UPSTREAM_PROTO string
+		S_TLS_SERVERNAME string
+		S_TLS_CAFILE     string
+		S_TLS_SPKI_PIN   string
+		timeout          int
+		max_entries      int64
+		expire_interval  int64
+		frag_mtu         int
+		S_FRAG_KEY       string
+		S_SIG0_KEY       string
 	)
 
 	flag.StringVar(&S_SERVERS, "proxy", "127.0.0.1:53", "we proxy requests to those servers")
 	flag.StringVar(&S_LISTEN, "listen", "8000", "listen on (both tcp and udp)")
 	flag.StringVar(&S_ACCESS, "access", "0.0.0.0/0", "allow those networks, use 0.0.0.0/0 to allow everything")
+	flag.StringVar(&S_UPSTREAM_PROTO, "upstream-proto", "dns", "default upstream transport for -proxy entries without a scheme: dns, doh or dot")
+	flag.StringVar(&S_TLS_SERVERNAME, "tls-servername", "", "override SNI/ServerName used for DoH/DoT upstreams")
+	flag.StringVar(&S_TLS_CAFILE, "tls-cafile", "", "PEM CA bundle to verify DoH/DoT upstreams against, instead of the system pool")
+	flag.StringVar(&S_TLS_SPKI_PIN, "tls-spki-pin", "", "base64 SHA-256 SPKI pin the DoH/DoT upstream certificate must match")
 	flag.IntVar(&timeout, "timeout", 5, "timeout")
 	flag.Int64Var(&expire_interval, "expire_interval", 300, "delete expired entries every N seconds")
 	flag.BoolVar(&DEBUG, "debug", false, "enable/disable debug")
 	flag.Int64Var(&max_entries, "max_cache_entries", 2000000, "max cache entries")
+	flag.IntVar(&frag_mtu, "frag-mtu", 0, "cap fragments at this size when it is smaller than the client's advertised UDP buffer, for path-MTU-constrained networks (0 = use client's size)")
+	flag.StringVar(&S_FRAG_KEY, "frag-key", "", "preshared key authenticating fragments with an HMAC, shared with the ClientProxy (empty = fragments are unauthenticated)")
+	flag.StringVar(&S_SIG0_KEY, "sig0-key", "", "path prefix (without .key/.private) of a dnssec-keygen keypair to sign fragments with SIG(0) instead of -frag-key")
 
 	flag.Parse()
+
+	if S_FRAG_KEY != "" && S_SIG0_KEY != "" {
+		// signFragment's HMAC is computed before sig0.Sign appends its SIG
+		// RR in ServeDNS's send loop, so the MAC would cover bytes that no
+		// longer match what's on the wire: ClientProxy's verifyFragment
+		// would then fail every fragment. Rather than silently racing the
+		// two, require the operator to pick one.
+		log.Fatal("-frag-key and -sig0-key are mutually exclusive, pick one fragment authentication mechanism")
+	}
+
 	servers := strings.Split(S_SERVERS, ",")
+
+	tls_cfg, err := LoadTLSConfig(S_TLS_SERVERNAME, S_TLS_CAFILE, S_TLS_SPKI_PIN)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	upstreams := make([]*Upstream, 0, len(servers))
+	for _, entry := range servers {
+		// a bare host:port is DoH/DoT only if -upstream-proto says so; an
+		// explicit https:// or tls:// scheme always wins
+		plain := entry
+		if S_UPSTREAM_PROTO == "doh" && !strings.Contains(entry, "://") {
+			plain = "https://" + entry + "/dns-query"
+		} else if S_UPSTREAM_PROTO == "dot" && !strings.Contains(entry, "://") {
+			plain = "tls://" + entry
+		}
+		upstream, err := ParseUpstream(plain, S_UPSTREAM_PROTO, tls_cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+
+	var frag_key []byte
+	if S_FRAG_KEY != "" {
+		frag_key = []byte(S_FRAG_KEY)
+	}
+
+	var sig0 *SIG0Signer
+	if S_SIG0_KEY != "" {
+		sig0, err = LoadSIG0Signer(S_SIG0_KEY)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	proxyer := ServerProxy{
 		giant:       new(sync.RWMutex),
 		ACCESS:      make([]*net.IPNet, 0),
 		SERVERS:     servers,
+		UPSTREAMS:   upstreams,
 		s_len:       len(servers),
 		NOW:         time.Now().UTC().Unix(),
 		entries:     0,
 		timeout:     time.Duration(timeout) * time.Second,
-		max_entries: max_entries}
+		max_entries: max_entries,
+		frag_mtu:    frag_mtu,
+		frag_key:    frag_key,
+		sig0:        sig0}
 
 	for _, mask := range strings.Split(S_ACCESS, ",") {
 		_, cidr, err := net.ParseCIDR(mask)
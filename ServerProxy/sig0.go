@@ -0,0 +1,82 @@
+// Optional SIG(0) (RFC 2931) signing of fragments, as an alternative to
+// the preshared-key HMAC in frag_auth.go: instead of a shared secret, the
+// fragment is signed with a private key and verifiable by any client that
+// has fetched our published KEY RR.
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SIG0Signer holds the key material needed to sign outgoing fragments with
+// a SIG(0) record: the private key itself, and the KEY RR that publishes
+// the matching public key (its owner name is what clients look up).
+type SIG0Signer struct {
+	key    crypto.Signer
+	key_rr *dns.KEY
+}
+
+// LoadSIG0Signer reads a BIND-style dnssec-keygen keypair: base is the path
+// without its .key / .private suffix (e.g. "/etc/Kfrag.example.+008+12345").
+//
+// TODO: only tested against freshly generated ECDSAP256SHA256 keys; other
+// algorithms should work via the same miekg/dns helpers but haven't been
+// exercised here.
+func LoadSIG0Signer(base string) (*SIG0Signer, error) {
+	pub, err := ioutil.ReadFile(base + ".key")
+	if err != nil {
+		return nil, fmt.Errorf("reading -sig0-key public half: %s", err)
+	}
+	rr, err := dns.NewRR(string(pub))
+	if err != nil {
+		return nil, fmt.Errorf("parsing -sig0-key KEY RR: %s", err)
+	}
+	key_rr, ok := rr.(*dns.KEY)
+	if !ok {
+		return nil, fmt.Errorf("-sig0-key %s.key is not a KEY record", base)
+	}
+
+	priv_file, err := ioutil.ReadFile(base + ".private")
+	if err != nil {
+		return nil, fmt.Errorf("reading -sig0-key private half: %s", err)
+	}
+	priv, err := key_rr.NewPrivateKey(string(priv_file))
+	if err != nil {
+		return nil, fmt.Errorf("parsing -sig0-key private key: %s", err)
+	}
+	key, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("-sig0-key algorithm does not support SIG(0) signing")
+	}
+
+	return &SIG0Signer{key: key, key_rr: key_rr}, nil
+}
+
+// Sign attaches a SIG(0) record covering msg's current wire bytes, so a
+// client that trusts our KEY RR can verify the fragment wasn't forged or
+// altered in transit, without needing a preshared HMAC key.
+func (s *SIG0Signer) Sign(msg *dns.Msg) error {
+	sig := new(dns.SIG)
+	sig.Hdr.Name = "."
+	sig.Hdr.Rrtype = dns.TypeSIG
+	sig.Hdr.Class = dns.ClassANY
+	sig.Algorithm = s.key_rr.Algorithm
+	sig.Expiration = uint32(time.Now().Add(5 * time.Minute).Unix())
+	sig.Inception = uint32(time.Now().Add(-5 * time.Minute).Unix())
+	sig.KeyTag = s.key_rr.KeyTag()
+	sig.SignerName = s.key_rr.Hdr.Name
+
+	// Sign packs msg itself (it needs the final RR counts to lay out the
+	// SIG record correctly) and returns the signed wire bytes with the SIG
+	// RR appended as the last additional record.
+	wire, err := sig.Sign(s.key, msg)
+	if err != nil {
+		return err
+	}
+	return msg.Unpack(wire)
+}
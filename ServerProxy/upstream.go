@@ -0,0 +1,265 @@
+// upstream transports for ServerProxy: plain DNS (udp/tcp), DNS-over-HTTPS
+// (RFC 8484) and DNS-over-TLS (RFC 7858).
+//
+// Fragmentation is applied by frag() to whatever reply comes back from
+// Exchange(), so the upstream transport is independent of whether we end up
+// fragmenting toward the client.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// the transport used to reach a given upstream
+type UpstreamProto int
+
+const (
+	ProtoDNS UpstreamProto = iota
+	ProtoDoH
+	ProtoDoT
+)
+
+// a single upstream server, already parsed from its -proxy entry
+type Upstream struct {
+	Proto  UpstreamProto
+	Addr   string // host:port for DNS/DoT, full URL for DoH
+	tls    *tls.Config
+	client *http.Client // shared, keep-alive DoH client
+	pool   *dotPool     // shared, keep-alive DoT connection pool
+}
+
+// ParseUpstream turns a -proxy entry into an Upstream, honouring an
+// explicit scheme (https://, tls://). Any other entry is plain DNS over
+// UDP; default_proto is not consulted here.
+func ParseUpstream(entry string, default_proto string, tls_cfg *tls.Config) (*Upstream, error) {
+	switch {
+	case strings.HasPrefix(entry, "https://"):
+		return &Upstream{
+			Proto:  ProtoDoH,
+			Addr:   entry,
+			tls:    tls_cfg,
+			client: newDoHClient(tls_cfg),
+		}, nil
+	case strings.HasPrefix(entry, "tls://"):
+		host := strings.TrimPrefix(entry, "tls://")
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			// no port given, DoT defaults to 853
+			host = net.JoinHostPort(host, "853")
+		}
+		return &Upstream{
+			Proto: ProtoDoT,
+			Addr:  host,
+			tls:   tls_cfg,
+			pool:  newDotPool(host, tls_cfg),
+		}, nil
+	default:
+		proto := ProtoDNS
+		_ = proto
+		return &Upstream{
+			Proto: ProtoDNS,
+			Addr:  entry,
+		}, nil
+	}
+}
+
+// LoadTLSConfig builds a *tls.Config from the -tls-* flags. server_name
+// overrides SNI (useful when connecting by IP, e.g. https://8.8.8.8/dns-query);
+// ca_file, if set, replaces the system root pool; spki_pin, if set, is the
+// base64 SHA-256 SPKI pin the leaf certificate must match.
+func LoadTLSConfig(server_name string, ca_file string, spki_pin string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: server_name}
+
+	if ca_file != "" {
+		pem, err := ioutil.ReadFile(ca_file)
+		if err != nil {
+			return nil, fmt.Errorf("reading -tls-cafile: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in -tls-cafile %s", ca_file)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if spki_pin != "" {
+		want := spki_pin
+		cfg.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+			for _, der := range certs {
+				if spkiPin(der) == want {
+					return nil
+				}
+			}
+			return fmt.Errorf("no certificate matched -tls-spki-pin")
+		}
+	}
+
+	return cfg, nil
+}
+
+// Exchange sends req to this upstream and returns the reply, using
+// whichever transport the upstream was parsed with.
+func (u *Upstream) Exchange(req *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	switch u.Proto {
+	case ProtoDoH:
+		return u.exchangeDoH(req, timeout)
+	case ProtoDoT:
+		return u.exchangeDoT(req, timeout)
+	default:
+		c := new(dns.Client)
+		c.ReadTimeout = timeout
+		c.WriteTimeout = timeout
+		return c.Exchange(req, u.Addr)
+	}
+}
+
+// --- DoH -------------------------------------------------------------
+
+// newDoHClient returns an http.Client tuned for DoH: keep-alive connection
+// pooling is the default behaviour of http.Transport, we just need to wire
+// in our TLS config and reasonable limits.
+func newDoHClient(tls_cfg *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:     tls_cfg,
+			MaxIdleConns:        64,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// exchangeDoH implements the RFC 8484 POST form: the DNS wire-format
+// message is the request body, content-type application/dns-message, and
+// the reply is read back the same way.
+func (u *Upstream) exchangeDoH(req *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	wire, err := req.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	httpreq, err := http.NewRequest("POST", u.Addr, bytes.NewReader(wire))
+	if err != nil {
+		return nil, 0, err
+	}
+	httpreq.Header.Set("Content-Type", "application/dns-message")
+	httpreq.Header.Set("Accept", "application/dns-message")
+
+	client := *u.client
+	client.Timeout = timeout
+	resp, err := client.Do(httpreq)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Since(start), fmt.Errorf("DoH upstream %s returned HTTP %d", u.Addr, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, time.Since(start), err
+	}
+	return reply, time.Since(start), nil
+}
+
+// --- DoT -------------------------------------------------------------
+
+// dotPool keeps a small number of persistent, TLS-wrapped DNS connections
+// to a single upstream alive between queries instead of paying a fresh
+// TCP+TLS handshake per request.
+type dotPool struct {
+	addr string
+	tls  *tls.Config
+	idle chan *dns.Conn
+}
+
+func newDotPool(addr string, tls_cfg *tls.Config) *dotPool {
+	return &dotPool{
+		addr: addr,
+		tls:  tls_cfg,
+		idle: make(chan *dns.Conn, 8),
+	}
+}
+
+func (p *dotPool) get(timeout time.Duration) (*dns.Conn, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	tls_conn, err := tls.DialWithDialer(dialer, "tcp", p.addr, p.tls)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: tls_conn}, nil
+}
+
+func (p *dotPool) put(conn *dns.Conn) {
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (u *Upstream) exchangeDoT(req *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	conn, err := u.pool.get(timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := conn.WriteMsg(req); err != nil {
+		conn.Close()
+		return nil, time.Since(start), err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	reply, err := conn.ReadMsg()
+	if err != nil {
+		conn.Close()
+		return nil, time.Since(start), err
+	}
+
+	u.pool.put(conn)
+	return reply, time.Since(start), nil
+}
+
+// spkiPin computes the base64 SHA-256 of the certificate's SubjectPublicKeyInfo.
+func spkiPin(der []byte) string {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parseUpstreamURL is a small helper kept around for callers that need to
+// validate a DoH URL up front (e.g. flag parsing) without constructing a
+// full Upstream.
+func parseUpstreamURL(raw string) (*url.URL, error) {
+	return url.Parse(raw)
+}